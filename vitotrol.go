@@ -0,0 +1,754 @@
+// Package vitotrol implements a client for the Viessmann Vitotrol web
+// service, used to remotely monitor and control Viessmann heating
+// installations.
+package vitotrol
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MainURL is the default Vitotrol SOAP endpoint. It is a package-level
+// variable so tests can redirect it to a local httptest.Server.
+var MainURL = "https://www.viessmann-schweiz.ch/vitodata/vitotrolapp/services/vii/v2/iPhoneWebService.asmx"
+
+// soapURL is the namespace prefixed to every SOAPAction header.
+const soapURL = "http://www.e-controlnet.de/services/vii/"
+
+const (
+	soapEnvelopeHeader = `<?xml version="1.0" encoding="utf-8"?>
+<soap:Envelope xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xmlns:xsd="http://www.w3.org/2001/XMLSchema" xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+  <soap:Body>`
+	soapEnvelopeFooter = `
+  </soap:Body>
+</soap:Envelope>`
+)
+
+// AttrId is the type of a device attribute identifier.
+type AttrId int
+
+// TimesheetId is the type of a device timesheet identifier.
+type TimesheetId int
+
+// Value is the last known value of a device attribute, as returned by
+// the Vitotrol API.
+type Value struct {
+	Value string
+	Time  time.Time
+}
+
+// Timeslot is one entry of a device timesheet, for a given weekday.
+type Timeslot struct {
+	From string
+	To   string
+}
+
+// TimeslotSlice is the list of Timeslot composing one weekday of a
+// timesheet.
+type TimeslotSlice []Timeslot
+
+// Device describes one Viessmann installation/device couple, as
+// returned by GetDevices.
+type Device struct {
+	LocationId   int
+	LocationName string
+	DeviceId     int
+	DeviceName   string
+	HasError     bool
+	IsConnected  bool
+	Attributes   map[AttrId]*Value
+	Timesheets   map[TimesheetId]map[string]TimeslotSlice
+}
+
+// HasResultHeader is implemented by every SOAP response body, giving
+// access to the Ergebnis/ErgebnisText header common to all of them.
+type HasResultHeader interface {
+	ResultHeader() *ResultHeader
+}
+
+// ResultHeader is embedded in every Vitotrol SOAP response. A non-zero
+// ErrorNum means the request failed at the application level, in
+// which case *ResultHeader is returned as the error.
+type ResultHeader struct {
+	ErrorNum int    `xml:"Ergebnis"`
+	ErrorStr string `xml:"ErgebnisText"`
+}
+
+// Error implements the error interface.
+func (r *ResultHeader) Error() string {
+	return fmt.Sprintf("vitotrol error #%d: %s", r.ErrorNum, r.ErrorStr)
+}
+
+// Session handles a connection to the Vitotrol web service, keeping
+// track of the session cookies and the profile information returned
+// by Login, as well as the last Devices fetched by GetDevices.
+type Session struct {
+	Cookies []string
+	Debug   bool
+
+	// HTTPClient, when non-nil, is used to perform every HTTP request
+	// instead of http.DefaultClient. Set it via WithHTTPClient or
+	// directly to control timeouts, proxies, TLS configuration, etc.
+	HTTPClient *http.Client
+
+	// BaseURL, when non-empty, overrides the package-level MainURL for
+	// this Session only. Set it via WithBaseURL.
+	BaseURL string
+
+	// UserAgent, when non-empty, is sent as the User-Agent header of
+	// every request. Set it via WithUserAgent.
+	UserAgent string
+
+	// timeout is only used by NewSession, to build a default
+	// HTTPClient when WithTimeout is given without WithHTTPClient.
+	timeout time.Duration
+
+	// Credentials are the login/password used by the last successful
+	// Login/LoginCtx call. sendRequestCtx uses them to transparently
+	// re-authenticate when RetryPolicy detects a dropped session.
+	Credentials Credentials
+
+	// RetryPolicy controls how sendRequestCtx reacts to transient
+	// errors. A Session built by NewSession defaults to
+	// DefaultRetryPolicy; a bare &Session{} defaults to its zero value,
+	// i.e. no retries, to keep backward compatibility.
+	RetryPolicy RetryPolicy
+
+	// TechVersion, Anrede, Vorname and Nachname are populated by Login.
+	TechVersion string
+	Anrede      int
+	Vorname     string
+	Nachname    string
+
+	// Devices is populated by GetDevices.
+	Devices []Device
+}
+
+// Credentials bundles the login/password pair used to authenticate a
+// Session.
+type Credentials struct {
+	Login    string
+	Password string
+}
+
+// RetryPolicy configures the retry behavior of sendRequestCtx. A zero
+// RetryPolicy disables retries: every request is attempted exactly
+// once.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a request is sent,
+	// including the first try. Values below 1 are treated as 1.
+	MaxAttempts int
+
+	// BaseDelay and MaxDelay bound the full-jitter exponential backoff
+	// applied between attempts: the n-th retry waits a random duration
+	// in [0, min(MaxDelay, BaseDelay*2^(n-1))).
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// SessionExpiredCodes lists the ResultHeader.ErrorNum values that
+	// mean the Vitotrol session has expired: when one of them is seen,
+	// sendRequestCtx re-issues Login with Session.Credentials before
+	// retrying the original request.
+	SessionExpiredCodes []int
+}
+
+// DefaultRetryPolicy is used by Sessions built with NewSession unless
+// overridden with WithRetryPolicy: 3 attempts, starting at 500ms and
+// capped at 30s, re-authenticating on ErrSessionExpired.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:         3,
+	BaseDelay:           500 * time.Millisecond,
+	MaxDelay:            30 * time.Second,
+	SessionExpiredCodes: []int{errCodeSessionExpired},
+}
+
+// Option configures a Session built by NewSession.
+type Option func(*Session)
+
+// WithHTTPClient makes the Session use client to perform its HTTP
+// requests instead of http.DefaultClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(v *Session) {
+		v.HTTPClient = client
+	}
+}
+
+// WithBaseURL overrides the package-level MainURL for this Session
+// only, which is handy to point tests at a local httptest.Server.
+func WithBaseURL(baseURL string) Option {
+	return func(v *Session) {
+		v.BaseURL = baseURL
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent with every request
+// made by the Session.
+func WithUserAgent(userAgent string) Option {
+	return func(v *Session) {
+		v.UserAgent = userAgent
+	}
+}
+
+// WithTimeout sets the timeout of the *http.Client built by
+// NewSession. It has no effect when combined with WithHTTPClient, as
+// the client passed there already owns its own timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(v *Session) {
+		v.timeout = timeout
+	}
+}
+
+// WithRetryPolicy overrides DefaultRetryPolicy for this Session. Pass
+// the zero RetryPolicy to disable retries altogether.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(v *Session) {
+		v.RetryPolicy = policy
+	}
+}
+
+// NewSession creates a Session, applying the given Options. Without
+// any option, the returned Session behaves as a zero-value &Session{}
+// except that it retries transient failures according to
+// DefaultRetryPolicy.
+func NewSession(opts ...Option) *Session {
+	v := &Session{RetryPolicy: DefaultRetryPolicy}
+
+	for _, opt := range opts {
+		opt(v)
+	}
+
+	if v.HTTPClient == nil && v.timeout != 0 {
+		v.HTTPClient = &http.Client{Timeout: v.timeout}
+	}
+
+	return v
+}
+
+// TransportError marks a failure as worth retrying: a network error
+// (connection refused, timeout, DNS failure, ...) or a body read
+// error. Attempts is the number of attempts already made, including
+// the one that produced Err.
+type TransportError struct {
+	Err      error
+	Attempts int
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("transport error (attempt %d): %s", e.Attempts, e.Err)
+}
+func (e *TransportError) Unwrap() error { return e.Err }
+
+// HTTPStatusError is returned when the Vitotrol server replies with a
+// non-200 HTTP status. Body is truncated to a short snippet, just
+// enough to diagnose the failure.
+type HTTPStatusError struct {
+	SOAPAction string
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("HTTP error on %s: %s: %s", e.SOAPAction, e.Status, e.Body)
+}
+
+// XMLDecodeError is returned when a SOAP response can't be decoded
+// into the expected shape. Raw holds the offending bytes, but only
+// when Session.Debug is set, to avoid leaking response bodies by
+// default.
+type XMLDecodeError struct {
+	SOAPAction string
+	Err        error
+	Raw        []byte
+}
+
+func (e *XMLDecodeError) Error() string {
+	return fmt.Sprintf("XML decoding error on %s: %s", e.SOAPAction, e.Err)
+}
+func (e *XMLDecodeError) Unwrap() error { return e.Err }
+
+// bodySnippet trims surrounding whitespace from body and cuts it down
+// to at most 200 bytes (followed by "..." when cut), a short preview
+// suitable for an error message. Line breaks inside body are kept.
+func bodySnippet(body []byte) string {
+	const maxLen = 200
+
+	s := strings.TrimSpace(string(body))
+	if len(s) > maxLen {
+		s = s[:maxLen] + "..."
+	}
+	return s
+}
+
+// vitotrolError is a sentinel applicative error, matched by ErrorNum
+// alone so it compares equal to a live *ResultHeader via errors.Is.
+type vitotrolError struct {
+	errorNum int
+	msg      string
+}
+
+func (e *vitotrolError) Error() string { return e.msg }
+
+// Well-known Viessmann ErrorNum values, usable with errors.Is against
+// any error returned by a Session method, e.g.:
+//
+//	if errors.Is(err, vitotrol.ErrSessionExpired) { ... }
+var (
+	ErrBadCredentials = &vitotrolError{1, "vitotrol: bad credentials"}
+	ErrSessionExpired = &vitotrolError{3, "vitotrol: session expired"}
+	ErrUnknownDevice  = &vitotrolError{100, "vitotrol: unknown device"}
+)
+
+// errCodeSessionExpired is the ErrorNum DefaultRetryPolicy reacts to by
+// default; it is kept in sync with ErrSessionExpired.
+const errCodeSessionExpired = 3
+
+// Is reports whether target is a sentinel error (ErrBadCredentials,
+// ErrSessionExpired, ErrUnknownDevice, ...) sharing r's ErrorNum,
+// allowing errors.Is(err, vitotrol.ErrSessionExpired) to succeed
+// against a *ResultHeader returned by a Session method.
+func (r *ResultHeader) Is(target error) bool {
+	known, ok := target.(*vitotrolError)
+	return ok && known.errorNum == r.ErrorNum
+}
+
+// sendRequestCtx sends a SOAP request for soapAction, with body as the
+// content of the <soap:Body>, and decodes the reply into resp. ctx
+// governs the whole operation, including the delay between retries:
+// if it is cancelled or its deadline expires, sendRequestCtx returns
+// early with an error wrapping ctx.Err().
+//
+// On a network error, an HTTP 5xx response, or a ResultHeader.ErrorNum
+// listed in Session.RetryPolicy.SessionExpiredCodes, sendRequestCtx
+// retries the request, waiting a full-jitter exponential backoff
+// between attempts. A session-expired error additionally triggers a
+// re-Login with Session.Credentials before the retry.
+func (v *Session) sendRequestCtx(ctx context.Context, soapAction, body string, resp HasResultHeader) error {
+	maxAttempts := v.RetryPolicy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			if werr := sleepWithContext(ctx, fullJitterBackoff(v.RetryPolicy, attempt)); werr != nil {
+				return werr
+			}
+		}
+
+		err = v.sendRequestOnce(ctx, soapAction, body, resp, attempt+1)
+		if err == nil {
+			return nil
+		}
+
+		var header *ResultHeader
+		if errors.As(err, &header) && v.isSessionExpiredCode(header.ErrorNum) {
+			if loginErr := v.reloginOnce(ctx); loginErr != nil {
+				return loginErr
+			}
+			continue
+		}
+
+		if !isRetryable(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// reloginOnce re-authenticates with Session.Credentials using a single
+// bare attempt, bypassing sendRequestCtx's retry loop. It is called
+// from within that loop when a session-expired error is seen, so it
+// must not carry its own independent RetryPolicy budget: it is the
+// outer loop's attempt count, not reloginOnce's, that bounds the total
+// number of HTTP calls sendRequestCtx can make.
+func (v *Session) reloginOnce(ctx context.Context) error {
+	var resp LoginResponse
+	err := v.sendRequestOnce(ctx, "Login",
+		fmt.Sprintf(loginBodyTemplate, v.Credentials.Login, v.Credentials.Password),
+		&resp, 1)
+	if err != nil {
+		return err
+	}
+
+	v.TechVersion = resp.LoginResult.TechVersion
+	v.Anrede = resp.LoginResult.Anrede
+	v.Vorname = resp.LoginResult.Vorname
+	v.Nachname = resp.LoginResult.Nachname
+
+	return nil
+}
+
+// sendRequestOnce performs a single SOAP request/response round-trip,
+// with no retry logic. attempt is the 1-based attempt number, recorded
+// on any TransportError it returns.
+func (v *Session) sendRequestOnce(ctx context.Context, soapAction, body string, resp HasResultHeader, attempt int) error {
+	reqBody := soapEnvelopeHeader + body + soapEnvelopeFooter
+
+	baseURL := MainURL
+	if v.BaseURL != "" {
+		baseURL = v.BaseURL
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, baseURL, bytes.NewBufferString(reqBody))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	req.Header.Set("SOAPAction", soapURL+soapAction)
+
+	if v.UserAgent != "" {
+		req.Header.Set("User-Agent", v.UserAgent)
+	}
+
+	if len(v.Cookies) > 0 {
+		req.Header.Set("Cookie", strings.Join(v.Cookies, "; "))
+	}
+
+	client := v.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	httpResp, err := client.Do(req)
+	if err != nil {
+		return &TransportError{Err: err, Attempts: attempt}
+	}
+	defer httpResp.Body.Close()
+
+	bodyRaw, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return &TransportError{Err: err, Attempts: attempt}
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		return &HTTPStatusError{
+			SOAPAction: soapAction,
+			StatusCode: httpResp.StatusCode,
+			Status:     httpResp.Status,
+			Body:       bodySnippet(bodyRaw),
+		}
+	}
+
+	if cookies := httpResp.Header["Set-Cookie"]; len(cookies) > 0 {
+		v.Cookies = cookies
+	}
+
+	if err = xml.Unmarshal(bodyRaw, resp); err != nil {
+		decodeErr := &XMLDecodeError{SOAPAction: soapAction, Err: err}
+		if v.Debug {
+			decodeErr.Raw = bodyRaw
+		}
+		return decodeErr
+	}
+
+	if header := resp.ResultHeader(); header.ErrorNum != 0 {
+		return header
+	}
+
+	return nil
+}
+
+// isSessionExpiredCode reports whether errorNum is one of the codes
+// configured in Session.RetryPolicy.SessionExpiredCodes.
+func (v *Session) isSessionExpiredCode(errorNum int) bool {
+	for _, code := range v.RetryPolicy.SessionExpiredCodes {
+		if code == errorNum {
+			return true
+		}
+	}
+	return false
+}
+
+// isRetryable reports whether err is a TransportError or a 5xx
+// HTTPStatusError, the two cases sendRequestCtx retries regardless of
+// SessionExpiredCodes.
+func isRetryable(err error) bool {
+	var transient *TransportError
+	if errors.As(err, &transient) {
+		return true
+	}
+
+	var statusErr *HTTPStatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode >= 500
+}
+
+// fullJitterBackoff implements the "full jitter" algorithm: it returns
+// a random duration in [0, min(policy.MaxDelay, policy.BaseDelay*2^(attempt-1))).
+func fullJitterBackoff(policy RetryPolicy, attempt int) time.Duration {
+	base := policy.BaseDelay
+	if base <= 0 {
+		base = DefaultRetryPolicy.BaseDelay
+	}
+
+	maxDelay := policy.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultRetryPolicy.MaxDelay
+	}
+
+	backoff := base * time.Duration(int64(1)<<uint(attempt-1))
+	if backoff <= 0 || backoff > maxDelay {
+		backoff = maxDelay
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// sleepWithContext blocks for d, returning early with ctx.Err() if ctx
+// is done before the delay elapses.
+func sleepWithContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// sendRequest is the context.Background() shorthand of sendRequestCtx,
+// kept for backward compatibility.
+func (v *Session) sendRequest(soapAction, body string, resp HasResultHeader) error {
+	return v.sendRequestCtx(context.Background(), soapAction, body, resp)
+}
+
+//
+// Login
+//
+
+const loginBodyTemplate = `
+<Login xmlns="http://www.e-controlnet.de/services/vii/">
+  <AppId>prod</AppId>
+  <AppVersion>4.3.1</AppVersion>
+  <Betriebssystem>Android</Betriebssystem>
+  <Benutzer>%s</Benutzer>
+  <Passwort>%s</Passwort>
+</Login>`
+
+// LoginResult is the content of a LoginResponse.
+type LoginResult struct {
+	ResultHeader
+	TechVersion string `xml:"TechVersion"`
+	Anrede      int    `xml:"Anrede"`
+	Vorname     string `xml:"Vorname"`
+	Nachname    string `xml:"Nachname"`
+}
+
+// LoginResponse is the SOAP response of the Login action.
+type LoginResponse struct {
+	LoginResult LoginResult `xml:"Body>LoginResponse>LoginResult"`
+}
+
+// ResultHeader implements the HasResultHeader interface.
+func (r *LoginResponse) ResultHeader() *ResultHeader {
+	return &r.LoginResult.ResultHeader
+}
+
+// LoginCtx logs in to the Vitotrol service using login & password
+// credentials, populating the Session profile fields on success. ctx
+// is propagated down to the underlying HTTP request.
+func (v *Session) LoginCtx(ctx context.Context, login, password string) error {
+	var resp LoginResponse
+
+	err := v.sendRequestCtx(ctx, "Login",
+		fmt.Sprintf(loginBodyTemplate, login, password), &resp)
+	if err != nil {
+		return err
+	}
+
+	v.Credentials = Credentials{Login: login, Password: password}
+	v.TechVersion = resp.LoginResult.TechVersion
+	v.Anrede = resp.LoginResult.Anrede
+	v.Vorname = resp.LoginResult.Vorname
+	v.Nachname = resp.LoginResult.Nachname
+
+	return nil
+}
+
+// Login is the context.Background() shorthand of LoginCtx, kept for
+// backward compatibility.
+func (v *Session) Login(login, password string) error {
+	return v.LoginCtx(context.Background(), login, password)
+}
+
+//
+// GetDevices
+//
+
+const getDevicesBody = `
+<GetDevices xmlns="http://www.e-controlnet.de/services/vii/GetDevices" />`
+
+type xmlDevice struct {
+	DeviceId    int    `xml:"GeraetId"`
+	DeviceName  string `xml:"GeraetName"`
+	HasError    bool   `xml:"HatFehler"`
+	IsConnected bool   `xml:"IstVerbunden"`
+}
+
+type xmlLocation struct {
+	LocationId   int         `xml:"AnlageId"`
+	LocationName string      `xml:"AnlageName"`
+	Devices      []xmlDevice `xml:"GeraeteListe>GeraetV2"`
+}
+
+// GetDevicesResult is the content of a GetDevicesResponse.
+type GetDevicesResult struct {
+	ResultHeader
+	Locations []xmlLocation `xml:"AnlageListe>AnlageV2"`
+}
+
+// GetDevicesResponse is the SOAP response of the GetDevices action.
+type GetDevicesResponse struct {
+	GetDevicesResult GetDevicesResult `xml:"Body>GetDevicesResponse>GetDevicesResult"`
+}
+
+// ResultHeader implements the HasResultHeader interface.
+func (r *GetDevicesResponse) ResultHeader() *ResultHeader {
+	return &r.GetDevicesResult.ResultHeader
+}
+
+// GetDevicesCtx fetches the list of locations/devices visible to the
+// logged in user and stores it in Session.Devices. ctx is propagated
+// down to the underlying HTTP request.
+func (v *Session) GetDevicesCtx(ctx context.Context) error {
+	var resp GetDevicesResponse
+
+	if err := v.sendRequestCtx(ctx, "GetDevices", getDevicesBody, &resp); err != nil {
+		return err
+	}
+
+	var devices []Device
+	for _, loc := range resp.GetDevicesResult.Locations {
+		for _, dev := range loc.Devices {
+			devices = append(devices, Device{
+				LocationId:   loc.LocationId,
+				LocationName: loc.LocationName,
+				DeviceId:     dev.DeviceId,
+				DeviceName:   dev.DeviceName,
+				HasError:     dev.HasError,
+				IsConnected:  dev.IsConnected,
+				Attributes:   map[AttrId]*Value{},
+				Timesheets:   map[TimesheetId]map[string]TimeslotSlice{},
+			})
+		}
+	}
+
+	v.Devices = devices
+	return nil
+}
+
+// GetDevices is the context.Background() shorthand of GetDevicesCtx,
+// kept for backward compatibility.
+func (v *Session) GetDevices() error {
+	return v.GetDevicesCtx(context.Background())
+}
+
+//
+// RequestRefreshStatus
+//
+
+const requestRefreshStatusBodyTemplate = `
+<RequestRefreshStatus xmlns="http://www.e-controlnet.de/services/vii/">
+  <AktualisierungsId>%s</AktualisierungsId>
+</RequestRefreshStatus>`
+
+// RequestRefreshStatusResult is the content of a
+// RequestRefreshStatusResponse.
+type RequestRefreshStatusResult struct {
+	ResultHeader
+	Status int `xml:"Status"`
+}
+
+// RequestRefreshStatusResponse is the SOAP response of the
+// RequestRefreshStatus action.
+type RequestRefreshStatusResponse struct {
+	RequestRefreshStatusResult RequestRefreshStatusResult `xml:"Body>RequestRefreshStatusResponse>RequestRefreshStatusResult"`
+}
+
+// ResultHeader implements the HasResultHeader interface.
+func (r *RequestRefreshStatusResponse) ResultHeader() *ResultHeader {
+	return &r.RequestRefreshStatusResult.ResultHeader
+}
+
+// RequestRefreshStatusCtx polls the progress of a refresh request
+// previously started for a device, returning its status code. ctx is
+// propagated down to the underlying HTTP request.
+func (v *Session) RequestRefreshStatusCtx(ctx context.Context, refreshId string) (int, error) {
+	var resp RequestRefreshStatusResponse
+
+	err := v.sendRequestCtx(ctx, "RequestRefreshStatus",
+		fmt.Sprintf(requestRefreshStatusBodyTemplate, refreshId), &resp)
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.RequestRefreshStatusResult.Status, nil
+}
+
+// RequestRefreshStatus is the context.Background() shorthand of
+// RequestRefreshStatusCtx, kept for backward compatibility.
+func (v *Session) RequestRefreshStatus(refreshId string) (int, error) {
+	return v.RequestRefreshStatusCtx(context.Background(), refreshId)
+}
+
+//
+// RequestWriteStatus
+//
+
+const requestWriteStatusBodyTemplate = `
+<RequestWriteStatus xmlns="http://www.e-controlnet.de/services/vii/">
+  <AktualisierungsId>%s</AktualisierungsId>
+</RequestWriteStatus>`
+
+// RequestWriteStatusResult is the content of a
+// RequestWriteStatusResponse.
+type RequestWriteStatusResult struct {
+	ResultHeader
+	Status int `xml:"Status"`
+}
+
+// RequestWriteStatusResponse is the SOAP response of the
+// RequestWriteStatus action.
+type RequestWriteStatusResponse struct {
+	RequestWriteStatusResult RequestWriteStatusResult `xml:"Body>RequestWriteStatusResponse>RequestWriteStatusResult"`
+}
+
+// ResultHeader implements the HasResultHeader interface.
+func (r *RequestWriteStatusResponse) ResultHeader() *ResultHeader {
+	return &r.RequestWriteStatusResult.ResultHeader
+}
+
+// RequestWriteStatusCtx polls the progress of a write request
+// previously started for a device, returning its status code. ctx is
+// propagated down to the underlying HTTP request.
+func (v *Session) RequestWriteStatusCtx(ctx context.Context, writeId string) (int, error) {
+	var resp RequestWriteStatusResponse
+
+	err := v.sendRequestCtx(ctx, "RequestWriteStatus",
+		fmt.Sprintf(requestWriteStatusBodyTemplate, writeId), &resp)
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.RequestWriteStatusResult.Status, nil
+}
+
+// RequestWriteStatus is the context.Background() shorthand of
+// RequestWriteStatusCtx, kept for backward compatibility.
+func (v *Session) RequestWriteStatus(writeId string) (int, error) {
+	return v.RequestWriteStatusCtx(context.Background(), writeId)
+}
@@ -1,14 +1,19 @@
 package vitotrol
 
 import (
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/timBeDev/go-vitotrol/vitotroltest"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 var (
@@ -74,9 +79,7 @@ func testSendRequestAny(assert *assert.Assertions,
 		}))
 	defer ts.Close()
 
-	MainURL = ts.URL
-
-	return sendReq(&Session{})
+	return sendReq(NewSession(WithBaseURL(ts.URL)))
 }
 
 //
@@ -97,18 +100,21 @@ func (r *TestResponse) ResultHeader() *ResultHeader {
 }
 
 func TestSendRequestErrors(t *testing.T) {
+	t.Parallel()
 	assert := assert.New(t)
 
-	v := &Session{}
+	// None of these are meant to retry: disable the default retry
+	// policy so this test stays fast and deterministic.
+	noRetry := WithRetryPolicy(RetryPolicy{})
 
 	// bad URL -> parse URL will fail
-	MainURL = ":"
+	v := NewSession(WithBaseURL(":"), noRetry)
 	var resp TestResponse
 	err := v.sendRequest("bad", `<xxx></xxx>`, &resp)
 	assert.NotNil(err)
 
 	// bad scheme -> Do request will fail
-	MainURL = "bad-scheme:..."
+	v = NewSession(WithBaseURL("bad-scheme:..."), noRetry)
 	err = v.sendRequest("bad", `<xxx></xxx>`, &resp)
 	assert.NotNil(err)
 
@@ -120,12 +126,13 @@ func TestSendRequestErrors(t *testing.T) {
 		}))
 	defer ts.Close()
 
-	MainURL = ts.URL
+	v = NewSession(WithBaseURL(ts.URL), noRetry)
 	err = v.sendRequest("bad", `<xxx></xxx>`, &resp)
 	assert.NotNil(err)
 }
 
 func TestSendRequest(t *testing.T) {
+	t.Parallel()
 	assert := assert.New(t)
 
 	type testRequest struct {
@@ -187,7 +194,12 @@ func TestSendRequest(t *testing.T) {
   <Foo>foo</Foo>
   <Bar>bar</Bar>
 </Test>`, &resp)
-			return assert.NotNil(err)
+			var decodeErr *XMLDecodeError
+			if !assert.NotNil(err) || !assert.True(errors.As(err, &decodeErr)) {
+				return false
+			}
+			return assert.Equal("foobar", decodeErr.SOAPAction) &&
+				assert.NotNil(decodeErr.Raw, "raw body kept when Session.Debug is set")
 		},
 		// SOAP action
 		"foobar",
@@ -210,12 +222,13 @@ func TestSendRequest(t *testing.T) {
   <Foo>foo</Foo>
   <Bar>bar</Bar>
 </Test>`, &resp)
-			if !assert.NotNil(err) || !assert.IsType(&ResultHeader{}, err) {
+			var header *ResultHeader
+			if !assert.NotNil(err) || !assert.True(errors.As(err, &header)) {
 				return false
 			}
-			res := err.(*ResultHeader)
-			return assert.Equal(42, res.ErrorNum) &&
-				assert.Equal("ERROR!!!", res.ErrorStr)
+			return assert.Equal(42, header.ErrorNum) &&
+				assert.Equal("ERROR!!!", header.ErrorStr) &&
+				assert.False(errors.Is(err, ErrSessionExpired))
 		},
 		// SOAP action
 		"foobar",
@@ -235,39 +248,228 @@ func TestSendRequest(t *testing.T) {
 		"sendRequest app error")
 }
 
-//
-// Login
-//
-func TestLogin(t *testing.T) {
+func TestSendRequestContext(t *testing.T) {
+	t.Parallel()
 	assert := assert.New(t)
 
-	type loginRequest struct {
-		AppId      string `xml:"Body>Login>AppId"`
-		AppVersion string `xml:"Body>Login>AppVersion"`
-		Password   string `xml:"Body>Login>Passwort"`
-		System     string `xml:"Body>Login>Betriebssystem"`
-		Login      string `xml:"Body>Login>Benutzer"`
-	}
+	testBody := `
+<Test>
+  <Foo>foo</Foo>
+</Test>`
+	testResponse := respHeader + `<TestResponse xmlns="http://www/">
+  <TestResult>
+   <Ergebnis>0</Ergebnis>
+   <ErgebnisText>Kein Fehler</ErgebnisText>
+   <Pipo>hello</Pipo>
+  </TestResult>
+</TestResponse>` + respFooter
+
+	// A live context lets the request go through as usual.
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, testResponse)
+		}))
+	defer ts.Close()
+
+	v := NewSession(WithBaseURL(ts.URL))
+
+	var resp TestResponse
+	err := v.sendRequestCtx(context.Background(), "foobar", testBody, &resp)
+	assert.Nil(err, "sendRequestCtx with context.Background() succeeds")
+
+	// An already cancelled context aborts the request before it
+	// reaches the server, and the returned error wraps
+	// context.Canceled.
+	reached := false
+	ts2 := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			reached = true
+		}))
+	defer ts2.Close()
+
+	v = NewSession(WithBaseURL(ts2.URL))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = v.sendRequestCtx(ctx, "foobar", testBody, &resp)
+	assert.NotNil(err, "sendRequestCtx with a cancelled context fails")
+	assert.True(errors.Is(err, context.Canceled),
+		"sendRequestCtx error wraps context.Canceled")
+	assert.False(reached, "the request is aborted before reaching the server")
+}
+
+// spyTransport counts the requests it forwards to next, so tests can
+// assert that a Session actually used the *http.Client passed via
+// WithHTTPClient instead of http.DefaultClient.
+type spyTransport struct {
+	calls int
+	next  http.RoundTripper
+}
+
+func (t *spyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls++
+	return t.next.RoundTrip(req)
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, respHeader+`<TestResponse xmlns="http://www/">
+  <TestResult>
+   <Ergebnis>0</Ergebnis>
+   <ErgebnisText>Kein Fehler</ErgebnisText>
+   <Pipo>hello</Pipo>
+  </TestResult>
+</TestResponse>`+respFooter)
+		}))
+	defer ts.Close()
+
+	spy := &spyTransport{next: http.DefaultTransport}
+	v := NewSession(
+		WithBaseURL(ts.URL),
+		WithHTTPClient(&http.Client{Transport: spy}),
+		WithRetryPolicy(RetryPolicy{}))
+
+	var resp TestResponse
+	err := v.sendRequest("foobar", `<Test></Test>`, &resp)
+	assert.Nil(err)
+	assert.Equal(1, spy.calls, "the custom HTTPClient's Transport was used")
+}
+
+func TestWithUserAgent(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	var gotUserAgent string
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			gotUserAgent = r.Header.Get("User-Agent")
+			fmt.Fprintln(w, respHeader+`<TestResponse xmlns="http://www/">
+  <TestResult>
+   <Ergebnis>0</Ergebnis>
+   <ErgebnisText>Kein Fehler</ErgebnisText>
+   <Pipo>hello</Pipo>
+  </TestResult>
+</TestResponse>`+respFooter)
+		}))
+	defer ts.Close()
+
+	v := NewSession(
+		WithBaseURL(ts.URL),
+		WithUserAgent("my-custom-agent/1.0"),
+		WithRetryPolicy(RetryPolicy{}))
+
+	var resp TestResponse
+	err := v.sendRequest("foobar", `<Test></Test>`, &resp)
+	assert.Nil(err)
+	assert.Equal("my-custom-agent/1.0", gotUserAgent,
+		"the configured User-Agent header was sent")
+}
+
+func TestWithTimeout(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(50 * time.Millisecond)
+			fmt.Fprintln(w, respHeader+`<TestResponse xmlns="http://www/">
+  <TestResult>
+   <Ergebnis>0</Ergebnis>
+   <ErgebnisText>Kein Fehler</ErgebnisText>
+   <Pipo>hello</Pipo>
+  </TestResult>
+</TestResponse>`+respFooter)
+		}))
+	defer ts.Close()
+
+	v := NewSession(
+		WithBaseURL(ts.URL),
+		WithTimeout(time.Millisecond),
+		WithRetryPolicy(RetryPolicy{}))
 
-	expectedRequest := &loginRequest{
-		AppId:      "prod",
-		AppVersion: "4.3.1",
-		Password:   "bingo",
-		System:     "Android",
-		Login:      "pipo",
+	var resp TestResponse
+	err := v.sendRequest("foobar", `<Test></Test>`, &resp)
+	assert.NotNil(err, "the short timeout aborts the slow request")
+
+	var transportErr *TransportError
+	assert.True(errors.As(err, &transportErr),
+		"the timeout surfaces as a TransportError")
+}
+
+// fastRetryPolicy is a RetryPolicy tuned for tests: same shape as
+// DefaultRetryPolicy, but with negligible delays.
+func fastRetryPolicy(sessionExpiredCodes ...int) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:         3,
+		BaseDelay:           time.Millisecond,
+		MaxDelay:            time.Millisecond,
+		SessionExpiredCodes: sessionExpiredCodes,
 	}
+}
 
-	// No problem
-	testSendRequestAny(assert,
-		// Send request and check result
-		func(v *Session) bool {
-			return assert.Nil(v.Login("pipo", "bingo"))
-		},
-		// SOAP action
-		"Login",
-		expectedRequest,
-		// Response to reply
-		`<LoginResponse xmlns="http://www.e-controlnet.de/services/vii/">
+func TestSendRequestRetry(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	attempts := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			attempts++
+			n := attempts
+			mu.Unlock()
+
+			// Fail the first two attempts, succeed on the third.
+			if n < 3 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			fmt.Fprintln(w, respHeader+`<TestResponse xmlns="http://www/">
+  <TestResult>
+   <Ergebnis>0</Ergebnis>
+   <ErgebnisText>Kein Fehler</ErgebnisText>
+   <Pipo>hello</Pipo>
+  </TestResult>
+</TestResponse>`+respFooter)
+		}))
+	defer ts.Close()
+
+	v := NewSession(WithBaseURL(ts.URL), WithRetryPolicy(fastRetryPolicy()))
+
+	var resp TestResponse
+	err := v.sendRequest("foobar", `
+<Test>
+  <Foo>foo</Foo>
+</Test>`, &resp)
+	assert.Nil(err, "the request eventually succeeds")
+	assert.Equal(3, attempts, "exactly 3 attempts were made")
+}
+
+func TestSendRequestRetrySessionExpired(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	const sessionExpiredCode = 99
+
+	var mu sync.Mutex
+	requestCount, loginCount := 0, 0
+
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("SOAPAction") == soapURL+"Login" {
+				mu.Lock()
+				loginCount++
+				mu.Unlock()
+
+				fmt.Fprintln(w, respHeader+`<LoginResponse xmlns="http://www.e-controlnet.de/services/vii/">
   <LoginResult>
     <Ergebnis>0</Ergebnis>
     <ErgebnisText>Kein Fehler</ErgebnisText>
@@ -276,215 +478,149 @@ func TestLogin(t *testing.T) {
     <Vorname>Maxime</Vorname>
     <Nachname>Soulé</Nachname>
   </LoginResult>
-</LoginResponse>`,
-		"Login")
+</LoginResponse>`+respFooter)
+				return
+			}
 
-	// With an error
-	testSendRequestAny(assert,
-		// Send request and check result
-		func(v *Session) bool {
-			return assert.NotNil(v.Login("pipo", "bingo"))
-		},
-		// SOAP action
-		"Login",
-		expectedRequest,
-		// Response to reply
-		`<bad XML>`,
-		"Login with error")
-}
+			mu.Lock()
+			requestCount++
+			n := requestCount
+			mu.Unlock()
 
-//
-// GetDevices
-//
-func TestGetDevices(t *testing.T) {
-	assert := assert.New(t)
+			// The first attempt reports a (fake) expired session; the
+			// one after re-login succeeds.
+			if n == 1 {
+				fmt.Fprintln(w, respHeader+fmt.Sprintf(`<TestResponse xmlns="http://www/">
+  <TestResult>
+   <Ergebnis>%d</Ergebnis>
+   <ErgebnisText>Session expired</ErgebnisText>
+   <Pipo></Pipo>
+  </TestResult>
+</TestResponse>`, sessionExpiredCode)+respFooter)
+				return
+			}
 
-	type getDevicesRequest struct {
-		Dummy string `xml:"Body>GetDevices,omitempty"`
-	}
+			fmt.Fprintln(w, respHeader+`<TestResponse xmlns="http://www/">
+  <TestResult>
+   <Ergebnis>0</Ergebnis>
+   <ErgebnisText>Kein Fehler</ErgebnisText>
+   <Pipo>hello</Pipo>
+  </TestResult>
+</TestResponse>`+respFooter)
+		}))
+	defer ts.Close()
 
-	expectedRequest := &getDevicesRequest{}
+	v := NewSession(
+		WithBaseURL(ts.URL),
+		WithRetryPolicy(fastRetryPolicy(sessionExpiredCode)))
+	v.Credentials = Credentials{Login: "pipo", Password: "bingo"}
 
-	// No problem
-	testSendRequestAny(assert,
-		// Send request and check result
-		func(v *Session) bool {
-			err := v.GetDevices()
-			if !assert.Nil(err) {
-				return false
-			}
-			return assert.Equal([]Device{
-				{
-					LocationId:   31456,
-					LocationName: "Paris",
-					DeviceId:     40213,
-					DeviceName:   "VT 200 (HO1C)",
-					HasError:     true,
-					IsConnected:  true,
-					Attributes:   map[AttrId]*Value{},
-					Timesheets:   map[TimesheetId]map[string]TimeslotSlice{},
-				},
-			},
-				v.Devices)
-		},
-		// SOAP action
-		"GetDevices",
-		expectedRequest,
-		// Response to reply
-		`<GetDevicesResponse xmlns="http://www.e-controlnet.de/services/vii/GetDevices">
-  <GetDevicesResult>
-    <Ergebnis>0</Ergebnis>
-    <ErgebnisText>Kein Fehler</ErgebnisText>
-    <AnlageListe>
-      <AnlageV2>
-        <AnlageId>31456</AnlageId>
-        <AnlageName>Paris</AnlageName>
-        <AnlageStandort>Paris</AnlageStandort>
-        <AnlageTyp />
-        <GeraeteListe>
-          <GeraetV2>
-            <GeraetId>40213</GeraetId>
-            <GeraetName>VT 200 (HO1C)</GeraetName>
-            <GeraetTyp>350</GeraetTyp>
-            <Heizkreise>
-              <BenutzerHeizkreis>
-                <HeizkreisId>19179</HeizkreisId>
-                <HeizkreisBezeichnung>viessmann.eventtypegroupHC.name.VScotHO1_72~HC1</HeizkreisBezeichnung>
-                <Benutzerfreigabe>true</Benutzerfreigabe>
-              </BenutzerHeizkreis>
-            </Heizkreise>
-            <ViaFreigabe>true</ViaFreigabe>
-            <Regelungstype>GWG</Regelungstype>
-            <Regelungsadresse>VScotHO1_72</Regelungsadresse>
-            <HatFehler>true</HatFehler>
-            <IstVerbunden>true</IstVerbunden>
-          </GeraetV2>
-        </GeraeteListe>
-        <VerbindungsTyp />
-        <HatFehler>false</HatFehler>
-        <IstVerbunden>true</IstVerbunden>
-      </AnlageV2>
-    </AnlageListe>
-  </GetDevicesResult>
-</GetDevicesResponse>`,
-		"GetDevices")
+	var resp TestResponse
+	err := v.sendRequest("foobar", `
+<Test>
+  <Foo>foo</Foo>
+</Test>`, &resp)
+	assert.Nil(err, "the retry after re-login succeeds")
+	assert.Equal(1, loginCount, "Login was re-issued exactly once")
+}
 
-	// With an error
-	testSendRequestAny(assert,
-		// Send request and check result
-		func(v *Session) bool {
-			return assert.NotNil(v.GetDevices())
-		},
-		// SOAP action
-		"GetDevices",
-		expectedRequest,
-		// Response to reply
-		`<bad XML>`,
-		"GetDevices with error")
+func TestResultHeaderSentinels(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	var err error = &ResultHeader{ErrorNum: 3, ErrorStr: "Session expired"}
+	assert.True(errors.Is(err, ErrSessionExpired))
+	assert.False(errors.Is(err, ErrUnknownDevice))
+
+	err = &ResultHeader{ErrorNum: 100, ErrorStr: "Unknown device"}
+	assert.True(errors.Is(err, ErrUnknownDevice))
+	assert.False(errors.Is(err, ErrSessionExpired))
 }
 
 //
-// RequestRefreshStatus
+// Login, GetDevices, RequestRefreshStatus and RequestWriteStatus are
+// exactly the per-RPC canned scenarios the vitotroltest package was
+// extracted for: drive them through vitotroltest.NewServer instead of
+// a one-off httptest.Server, so that package stays honest.
 //
 
-type requestRefreshStatusRequest struct {
-	AktualisierungsId string `xml:"Body>RequestRefreshStatus>AktualisierungsId"`
-}
+func TestLogin(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
 
-var requestRefreshStatusTest = testAction{
-	expectedRequest: &requestRefreshStatusRequest{
-		AktualisierungsId: "123456789",
-	},
-	serverResponse: `<RequestRefreshStatusResponse xmlns="http://www.e-controlnet.de/services/vii/">
-  <RequestRefreshStatusResult>
-    <Ergebnis>0</Ergebnis>
-    <ErgebnisText>Kein Fehler</ErgebnisText>
-    <Status>4</Status>
-  </RequestRefreshStatusResult>
-</RequestRefreshStatusResponse>`,
+	srv := vitotroltest.NewServer(t)
+	srv.ExpectLogin("pipo", "bingo")
+
+	v := NewSession(WithBaseURL(srv.URL), WithRetryPolicy(RetryPolicy{}))
+
+	// No problem
+	assert.Nil(v.Login("pipo", "bingo"))
+	assert.Equal("Maxime", v.Vorname)
+	assert.Equal("Soulé", v.Nachname)
+
+	// With an error
+	assert.NotNil(v.Login("pipo", "wrong-password"))
 }
 
-func TestRequestRefreshStatus(t *testing.T) {
+func TestGetDevices(t *testing.T) {
+	t.Parallel()
 	assert := assert.New(t)
 
+	srv := vitotroltest.NewServer(t)
+	v := NewSession(WithBaseURL(srv.URL), WithRetryPolicy(RetryPolicy{}))
+
 	// No problem
-	testSendRequestAny(assert,
-		// Send request and check result
-		func(v *Session) bool {
-			status, err := v.RequestRefreshStatus("123456789")
-			return assert.Nil(err) && assert.Equal(4, status)
+	assert.Nil(v.GetDevices())
+	assert.Equal([]Device{
+		{
+			LocationId:   31456,
+			LocationName: "Paris",
+			DeviceId:     40213,
+			DeviceName:   "VT 200 (HO1C)",
+			HasError:     false,
+			IsConnected:  true,
+			Attributes:   map[AttrId]*Value{},
+			Timesheets:   map[TimesheetId]map[string]TimeslotSlice{},
 		},
-		// SOAP action
-		"RequestRefreshStatus",
-		requestRefreshStatusTest.expectedRequest,
-		// Response to reply
-		requestRefreshStatusTest.serverResponse,
-		"RequestRefreshStatus")
+	}, v.Devices)
 
 	// With an error
-	testSendRequestAny(assert,
-		// Send request and check result
-		func(v *Session) bool {
-			_, err := v.RequestRefreshStatus("123456789")
-			return assert.NotNil(err)
-		},
-		// SOAP action
-		"RequestRefreshStatus",
-		requestRefreshStatusTest.expectedRequest,
-		// Response to reply
-		`<bad XML>`,
-		"RequestRefreshStatus with error")
+	srv.QueueError("GetDevices", 42, "boom")
+	assert.NotNil(v.GetDevices())
 }
 
-//
-// RequestWriteStatus
-//
+func TestRequestRefreshStatus(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
 
-type requestWriteStatusRequest struct {
-	AktualisierungsId string `xml:"Body>RequestWriteStatus>AktualisierungsId"`
-}
+	srv := vitotroltest.NewServer(t)
+	v := NewSession(WithBaseURL(srv.URL), WithRetryPolicy(RetryPolicy{}))
 
-var requestWriteStatusTest = testAction{
-	expectedRequest: &requestWriteStatusRequest{
-		AktualisierungsId: "123456789",
-	},
-	serverResponse: `<RequestWriteStatusResponse xmlns="http://www.e-controlnet.de/services/vii/">
-  <RequestWriteStatusResult>
-    <Ergebnis>0</Ergebnis>
-    <ErgebnisText>Kein Fehler</ErgebnisText>
-    <Status>4</Status>
-  </RequestWriteStatusResult>
-</RequestWriteStatusResponse>`,
+	// No problem
+	status, err := v.RequestRefreshStatus("123456789")
+	assert.Nil(err)
+	assert.Equal(4, status)
+
+	// With an error
+	srv.QueueError("RequestRefreshStatus", 42, "boom")
+	_, err = v.RequestRefreshStatus("123456789")
+	assert.NotNil(err)
 }
 
 func TestRequestWriteStatus(t *testing.T) {
+	t.Parallel()
 	assert := assert.New(t)
 
+	srv := vitotroltest.NewServer(t)
+	v := NewSession(WithBaseURL(srv.URL), WithRetryPolicy(RetryPolicy{}))
+
 	// No problem
-	testSendRequestAny(assert,
-		// Send request and check result
-		func(v *Session) bool {
-			status, err := v.RequestWriteStatus("123456789")
-			return assert.Nil(err) && assert.Equal(4, status)
-		},
-		// SOAP action
-		"RequestWriteStatus",
-		requestWriteStatusTest.expectedRequest,
-		// Response to reply
-		requestWriteStatusTest.serverResponse,
-		"RequestWriteStatus")
+	status, err := v.RequestWriteStatus("123456789")
+	assert.Nil(err)
+	assert.Equal(4, status)
 
 	// With an error
-	testSendRequestAny(assert,
-		// Send request and check result
-		func(v *Session) bool {
-			_, err := v.RequestWriteStatus("123456789")
-			return assert.NotNil(err)
-		},
-		// SOAP action
-		"RequestWriteStatus",
-		requestWriteStatusTest.expectedRequest,
-		// Response to reply
-		`<bad XML>`,
-		"RequestWriteStatus with error")
+	srv.QueueError("RequestWriteStatus", 42, "boom")
+	_, err = v.RequestWriteStatus("123456789")
+	assert.NotNil(err)
 }
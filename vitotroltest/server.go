@@ -0,0 +1,240 @@
+// Package vitotroltest provides a scriptable fake of the Viessmann
+// Vitotrol SOAP service, meant to be embedded in the test suites of
+// programs built on top of github.com/timBeDev/go-vitotrol.
+//
+// Deviation from the original request: it also asked for
+// Server.SetAttribute(deviceID, attrID, value) to script a GetData
+// reply. vitotrol.Session has no GetData RPC to drive that scripting
+// against, so SetAttribute and the GetData canned-reply path were
+// dropped rather than shipped untested; re-add them once a GetData
+// method lands on Session.
+package vitotroltest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	soapURL = "http://www.e-controlnet.de/services/vii/"
+
+	respHeader = `<?xml version="1.0" encoding="utf-8"?><soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xmlns:xsd="http://www.w3.org/2001/XMLSchema"><soap:Body>`
+	respFooter = `</soap:Body></soap:Envelope>`
+)
+
+// reply is one scripted response, queued for a given SOAP action.
+type reply struct {
+	body string
+}
+
+// Server is a scriptable fake of the Vitotrol SOAP service, backed by
+// a local *httptest.Server. Build one with NewServer, point a
+// vitotrol.Session at it with vitotrol.WithBaseURL(srv.URL), then
+// script its behavior with ExpectLogin, QueueRefresh and QueueError.
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	queues    map[string][]reply
+	loginUser string
+	loginPass string
+}
+
+// NewServer starts a Server preloaded with realistic canned replies
+// for the Login, GetDevices, RequestRefreshStatus and
+// RequestWriteStatus actions. It is closed automatically when the
+// test it belongs to completes.
+func NewServer(t *testing.T) *Server {
+	s := &Server{
+		queues: map[string][]reply{},
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Server.Close)
+
+	return s
+}
+
+// ExpectLogin makes Login succeed only for this exact user/password
+// pair; any other credentials get the applicative "wrong credentials"
+// error. Without a call to ExpectLogin, Login always succeeds.
+func (s *Server) ExpectLogin(user, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.loginUser, s.loginPass = user, password
+}
+
+// QueueRefresh schedules status to be returned by the next
+// RequestRefreshStatus call. Without any call to QueueRefresh,
+// RequestRefreshStatus replies with status 4 (refresh complete).
+func (s *Server) QueueRefresh(status int) {
+	s.queueReply("RequestRefreshStatus",
+		fmt.Sprintf(refreshStatusBodyTemplate, "RequestRefreshStatus", status))
+}
+
+// QueueError makes the next call for soapAction fail with the given
+// applicative error instead of its usual canned reply.
+func (s *Server) QueueError(soapAction string, errorNum int, errorStr string) {
+	s.queueReply(soapAction, errorBody(soapAction, errorNum, errorStr))
+}
+
+func (s *Server) queueReply(soapAction, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queues[soapAction] = append(s.queues[soapAction], reply{body: body})
+}
+
+func (s *Server) popQueuedReply(soapAction string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue := s.queues[soapAction]
+	if len(queue) == 0 {
+		return "", false
+	}
+
+	s.queues[soapAction] = queue[1:]
+	return queue[0].body, true
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	soapAction := strings.TrimPrefix(r.Header.Get("SOAPAction"), soapURL)
+
+	bodyRaw, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if cookie := r.Header.Get("Cookie"); cookie != "" {
+		w.Header().Add("Set-Cookie", cookie)
+	}
+
+	body, ok := s.popQueuedReply(soapAction)
+	if !ok {
+		body, err = s.defaultReply(soapAction, bodyRaw)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	fmt.Fprintln(w, respHeader+body+respFooter)
+}
+
+// mirror allocates a fresh value of the same type as template and
+// unmarshals raw into it, the same "virgin instance" trick the
+// vitotrol package's own tests use to decode a request into a
+// known-shape mirror struct.
+func mirror(template interface{}, raw []byte) (interface{}, error) {
+	v := reflect.New(reflect.Indirect(reflect.ValueOf(template)).Type()).Interface()
+	if err := xml.Unmarshal(raw, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+type xmlLoginRequest struct {
+	Login    string `xml:"Body>Login>Benutzer"`
+	Password string `xml:"Body>Login>Passwort"`
+}
+
+func (s *Server) defaultReply(soapAction string, bodyRaw []byte) (string, error) {
+	switch soapAction {
+	case "Login":
+		parsed, err := mirror(&xmlLoginRequest{}, bodyRaw)
+		if err != nil {
+			return "", err
+		}
+		req := parsed.(*xmlLoginRequest)
+
+		s.mu.Lock()
+		wantUser, wantPass := s.loginUser, s.loginPass
+		s.mu.Unlock()
+
+		if wantUser != "" && (req.Login != wantUser || req.Password != wantPass) {
+			return errorBody("Login", 1,
+				"Unbekannter Benutzername oder falsches Passwort"), nil
+		}
+
+		return loginSuccessBody, nil
+
+	case "GetDevices":
+		return getDevicesSuccessBody, nil
+
+	case "RequestRefreshStatus", "RequestWriteStatus":
+		return fmt.Sprintf(refreshStatusBodyTemplate, soapAction, 4), nil
+
+	default:
+		return "", fmt.Errorf(
+			"vitotroltest: no canned reply scripted for SOAPAction %q", soapAction)
+	}
+}
+
+// errorBody renders the generic "<Action>Response>...Result" shape
+// used by every Vitotrol action when it fails at the application
+// level.
+func errorBody(soapAction string, errorNum int, errorStr string) string {
+	return fmt.Sprintf(`<%[1]sResponse xmlns="http://www.e-controlnet.de/services/vii/">
+  <%[1]sResult>
+    <Ergebnis>%[2]d</Ergebnis>
+    <ErgebnisText>%[3]s</ErgebnisText>
+  </%[1]sResult>
+</%[1]sResponse>`, soapAction, errorNum, errorStr)
+}
+
+const loginSuccessBody = `<LoginResponse xmlns="http://www.e-controlnet.de/services/vii/">
+  <LoginResult>
+    <Ergebnis>0</Ergebnis>
+    <ErgebnisText>Kein Fehler</ErgebnisText>
+    <TechVersion>2.5.6.0</TechVersion>
+    <Anrede>1</Anrede>
+    <Vorname>Maxime</Vorname>
+    <Nachname>Soulé</Nachname>
+  </LoginResult>
+</LoginResponse>`
+
+const getDevicesSuccessBody = `<GetDevicesResponse xmlns="http://www.e-controlnet.de/services/vii/GetDevices">
+  <GetDevicesResult>
+    <Ergebnis>0</Ergebnis>
+    <ErgebnisText>Kein Fehler</ErgebnisText>
+    <AnlageListe>
+      <AnlageV2>
+        <AnlageId>31456</AnlageId>
+        <AnlageName>Paris</AnlageName>
+        <AnlageStandort>Paris</AnlageStandort>
+        <AnlageTyp />
+        <GeraeteListe>
+          <GeraetV2>
+            <GeraetId>40213</GeraetId>
+            <GeraetName>VT 200 (HO1C)</GeraetName>
+            <GeraetTyp>350</GeraetTyp>
+            <HatFehler>false</HatFehler>
+            <IstVerbunden>true</IstVerbunden>
+          </GeraetV2>
+        </GeraeteListe>
+        <VerbindungsTyp />
+        <HatFehler>false</HatFehler>
+        <IstVerbunden>true</IstVerbunden>
+      </AnlageV2>
+    </AnlageListe>
+  </GetDevicesResult>
+</GetDevicesResponse>`
+
+const refreshStatusBodyTemplate = `<%[1]sResponse xmlns="http://www.e-controlnet.de/services/vii/">
+  <%[1]sResult>
+    <Ergebnis>0</Ergebnis>
+    <ErgebnisText>Kein Fehler</ErgebnisText>
+    <Status>%[2]d</Status>
+  </%[1]sResult>
+</%[1]sResponse>`
+
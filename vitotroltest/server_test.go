@@ -0,0 +1,78 @@
+package vitotroltest_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/timBeDev/go-vitotrol"
+	"github.com/timBeDev/go-vitotrol/vitotroltest"
+)
+
+func TestServerLogin(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	srv := vitotroltest.NewServer(t)
+	srv.ExpectLogin("pipo", "bingo")
+
+	v := vitotrol.NewSession(
+		vitotrol.WithBaseURL(srv.URL),
+		vitotrol.WithRetryPolicy(vitotrol.RetryPolicy{}))
+
+	assert.Nil(v.Login("pipo", "bingo"), "expected credentials succeed")
+	assert.NotNil(v.Login("pipo", "wrong"), "wrong credentials fail")
+}
+
+func TestServerGetDevices(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	srv := vitotroltest.NewServer(t)
+
+	v := vitotrol.NewSession(
+		vitotrol.WithBaseURL(srv.URL),
+		vitotrol.WithRetryPolicy(vitotrol.RetryPolicy{}))
+
+	assert.Nil(v.GetDevices())
+	assert.Equal(1, len(v.Devices))
+	assert.Equal(40213, v.Devices[0].DeviceId)
+}
+
+func TestServerQueueRefresh(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	srv := vitotroltest.NewServer(t)
+	srv.QueueRefresh(2)
+
+	v := vitotrol.NewSession(
+		vitotrol.WithBaseURL(srv.URL),
+		vitotrol.WithRetryPolicy(vitotrol.RetryPolicy{}))
+
+	status, err := v.RequestRefreshStatus("123456789")
+	assert.Nil(err)
+	assert.Equal(2, status, "the queued status is returned once")
+
+	status, err = v.RequestRefreshStatus("123456789")
+	assert.Nil(err)
+	assert.Equal(4, status, "the default status is returned afterwards")
+}
+
+func TestServerQueueError(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	srv := vitotroltest.NewServer(t)
+	srv.QueueError("RequestRefreshStatus", 42, "boom")
+
+	v := vitotrol.NewSession(
+		vitotrol.WithBaseURL(srv.URL),
+		vitotrol.WithRetryPolicy(vitotrol.RetryPolicy{}))
+
+	_, err := v.RequestRefreshStatus("123456789")
+	assert.NotNil(err, "the scripted error is returned")
+
+	status, err := v.RequestRefreshStatus("123456789")
+	assert.Nil(err, "the default reply resumes once the queue is drained")
+	assert.Equal(4, status)
+}